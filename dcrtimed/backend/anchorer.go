@@ -0,0 +1,29 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+// Anchorer abstracts over how a SQL-backed backend (postgres, cockroachdb)
+// publishes a flush's Merkle root on-chain. It exists so the hourly flush
+// cron is not hardwired to dcrwallet: an Anchorer implementation may talk
+// to dcrwallet, to any other wire-compatible chain over RPC, or simply
+// record the flush without publishing anywhere for deployments that want
+// collection without anchoring.
+type Anchorer interface {
+	// Publish broadcasts a transaction that commits to root and returns
+	// its transaction hash.
+	Publish(root [32]byte) (txHash string, err error)
+
+	// Confirmations returns the number of confirmations txHash has, and
+	// the height it was mined at, or an error if it cannot be found.
+	Confirmations(txHash string) (uint32, int64, error)
+
+	// Balance returns balance information for the account that funds
+	// Publish, if the underlying implementation has one.
+	Balance() (*GetBalanceResult, error)
+
+	// Close releases any resources (wallet RPC connections, etc.) held
+	// by the Anchorer.
+	Close()
+}
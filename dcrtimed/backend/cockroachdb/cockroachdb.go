@@ -0,0 +1,803 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package cockroachdb is a CockroachDB implementation of the backend
+// interface. CockroachDB speaks the Postgres wire protocol, so it reuses
+// the query set from sqlbackend; what differs from the postgres backend is
+// how primary keys are generated (unique_rowid() instead of a serial
+// sequence, since Cockroach does not allocate contiguous ids across
+// nodes), how transactions are retried (Cockroach's SERIALIZABLE isolation
+// can abort a transaction with SQLSTATE 40001 under contention, where
+// Postgres would simply block), and how a single instance is elected to
+// run the hourly flush cron (a row lock on a `leader` table, since
+// Cockroach has no advisory lock primitive).
+package cockroachdb
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrtime/dcrtimed/backend"
+	"github.com/decred/dcrtime/dcrtimed/backend/cockroachdb/migrations"
+	"github.com/decred/dcrtime/dcrtimed/backend/dcrwalletanchor"
+	"github.com/decred/dcrtime/dcrtimed/backend/sqlbackend"
+	"github.com/decred/dcrtime/merkle"
+	"github.com/lib/pq"
+	"github.com/robfig/cron"
+)
+
+var (
+	_ backend.Backend = (*CockroachDB)(nil)
+
+	flushSchedule = "10 0 * * * *" // On the hour + 10 seconds
+	duration      = time.Hour      // Default how often we combine digests
+
+	// leaderTTL bounds how long a stale leader row is honored before
+	// another instance is allowed to take over the flush cron.
+	leaderTTL int64 = 300
+)
+
+// CockroachDB is a CockroachDB implementation of a backend. It stores
+// digests and anchors in the same records/anchors schema as the postgres
+// backend, and shares that backend's SQL statements via sqlbackend.
+type CockroachDB struct {
+	sync.RWMutex
+
+	cron     *cron.Cron
+	db       *sql.DB
+	duration time.Duration
+	commit   uint
+
+	enableCollections bool
+
+	wallet  backend.Anchorer
+	queries sqlbackend.Queries
+
+	owner       string // Unique identifier used to contend for the leader row
+	merklePaths map[string]*merkle.Branch
+
+	myNow   func() time.Time
+	testing bool
+}
+
+func (cdb *CockroachDB) bucket(t time.Time) string {
+	return strconv.FormatInt(t.Truncate(cdb.duration).Unix(), 10)
+}
+
+// Put stores hashes and returns timestamp and associated errors. Unlike the
+// postgres backend, each insert attempt runs inside sqlbackend's CRDB retry
+// wrapper so a transient serialization conflict does not surface to the
+// caller as a failed Put.
+func (cdb *CockroachDB) Put(digests [][sha256.Size]byte) (int64, []backend.PutResult, error) {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	now := cdb.myNow()
+	ts := now.Truncate(cdb.duration).Unix()
+	bucket := cdb.bucket(now)
+
+	prs := make([]backend.PutResult, 0, len(digests))
+	for _, d := range digests {
+		err := sqlbackend.RunWithCRDBRetry(cdb.db, func(tx *sql.Tx) error {
+			_, err := tx.Exec(cdb.queries.InsertRecord, d[:], bucket)
+			return err
+		})
+		switch {
+		case err == nil:
+			prs = append(prs, backend.PutResult{
+				Digest:    d,
+				ErrorCode: backend.ErrorOK,
+			})
+		case isUniqueViolation(err):
+			prs = append(prs, backend.PutResult{
+				Digest:    d,
+				ErrorCode: backend.ErrorExists,
+			})
+		default:
+			return 0, nil, fmt.Errorf("insert digest %x: %v", d, err)
+		}
+	}
+
+	return ts, prs, nil
+}
+
+// Get returns timestamp information for the given digests.
+func (cdb *CockroachDB) Get(digests [][sha256.Size]byte) ([]backend.GetResult, error) {
+	// get may populate cdb.merklePaths, so this needs the exclusive lock
+	// rather than a read lock.
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	grs := make([]backend.GetResult, 0, len(digests))
+	for _, d := range digests {
+		gr, err := cdb.get(d)
+		if err != nil {
+			return nil, err
+		}
+		grs = append(grs, *gr)
+	}
+	return grs, nil
+}
+
+func (cdb *CockroachDB) get(digest [sha256.Size]byte) (*backend.GetResult, error) {
+	var (
+		anchorMerkle sql.NullString
+		collectionTS string
+		flushTS      sql.NullInt64
+		chainTS      sql.NullInt64
+		txHash       sql.NullString
+	)
+	row := cdb.db.QueryRow(cdb.queries.SelectRecordGet, digest[:])
+	err := row.Scan(&anchorMerkle, &collectionTS, &flushTS, &chainTS, &txHash)
+	switch {
+	case err == sql.ErrNoRows:
+		return &backend.GetResult{
+			Digest:    digest,
+			ErrorCode: backend.ErrorNotFound,
+		}, nil
+	case err != nil:
+		return nil, fmt.Errorf("get digest %x: %v", digest, err)
+	}
+
+	gr := &backend.GetResult{
+		Digest:    digest,
+		ErrorCode: backend.ErrorOK,
+	}
+
+	if !anchorMerkle.Valid {
+		return gr, nil
+	}
+
+	gr.AnchoredTimestamp = flushTS.Int64
+
+	if txHash.Valid && txHash.String != "" {
+		tx, err := chainhash.NewHashFromStr(txHash.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse tx hash %v: %v", txHash.String, err)
+		}
+		gr.Tx = *tx
+	}
+
+	root, branch, err := cdb.merklePath(anchorMerkle.String, digest)
+	if err != nil {
+		return nil, err
+	}
+	gr.MerkleRoot = root
+	gr.MerklePath = *branch
+
+	return gr, nil
+}
+
+// merklePath returns the merkle root and authentication path for digest
+// within the anchor identified by merkleRoot (the anchors.merkle column,
+// hex encoded). Paths are cached in cdb.merklePaths per anchor and digest,
+// since the set of digests behind an anchor does not change once flushed.
+// The caller must hold cdb.Lock(), since this populates that map.
+func (cdb *CockroachDB) merklePath(merkleRoot string, digest [sha256.Size]byte) ([sha256.Size]byte, *merkle.Branch, error) {
+	var root [sha256.Size]byte
+	rootBytes, err := hex.DecodeString(merkleRoot)
+	if err != nil {
+		return root, nil, fmt.Errorf("decode merkle root %q: %v", merkleRoot, err)
+	}
+	copy(root[:], rootBytes)
+
+	cacheKey := merkleRoot + hex.EncodeToString(digest[:])
+	if branch, ok := cdb.merklePaths[cacheKey]; ok {
+		return root, branch, nil
+	}
+
+	rows, err := cdb.db.Query(cdb.queries.SelectAnchorDigests, merkleRoot)
+	if err != nil {
+		return root, nil, fmt.Errorf("select anchor digests: %v", err)
+	}
+	defer rows.Close()
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return root, nil, fmt.Errorf("scan anchor digest: %v", err)
+		}
+		var dd [sha256.Size]byte
+		copy(dd[:], b)
+		digests = append(digests, dd)
+	}
+
+	leaves := make([]*[sha256.Size]byte, len(digests))
+	for i := range digests {
+		leaves[i] = &digests[i]
+	}
+	branch := merkle.AuthPath(leaves, &digest)
+
+	if cdb.merklePaths == nil {
+		cdb.merklePaths = make(map[string]*merkle.Branch)
+	}
+	cdb.merklePaths[cacheKey] = branch
+
+	return root, branch, nil
+}
+
+// GetTimestamps returns all hashes for given timestamps.
+func (cdb *CockroachDB) GetTimestamps(timestamps []int64) ([]backend.TimestampResult, error) {
+	if !cdb.enableCollections {
+		return nil, backend.ErrTryAgainLater
+	}
+
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	trs := make([]backend.TimestampResult, 0, len(timestamps))
+	for _, ts := range timestamps {
+		bucket := strconv.FormatInt(ts, 10)
+		rows, err := cdb.db.Query(cdb.queries.SelectTimestamp, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("select timestamp %v: %v", ts, err)
+		}
+
+		var digests [][sha256.Size]byte
+		for rows.Next() {
+			var b []byte
+			if err := rows.Scan(&b); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan timestamp digest: %v", err)
+			}
+			var d [sha256.Size]byte
+			copy(d[:], b)
+			digests = append(digests, d)
+		}
+		rows.Close()
+
+		trs = append(trs, backend.TimestampResult{
+			Timestamp: ts,
+			Digests:   digests,
+		})
+	}
+
+	return trs, nil
+}
+
+// LastDigests returns timestamp information for the n most recently
+// collected digests.
+func (cdb *CockroachDB) LastDigests(n int32) ([]backend.GetResult, error) {
+	rows, err := cdb.db.Query(cdb.queries.SelectLastDigests, n)
+	if err != nil {
+		return nil, fmt.Errorf("select last digests: %v", err)
+	}
+	defer rows.Close()
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, fmt.Errorf("scan last digest: %v", err)
+		}
+		var d [sha256.Size]byte
+		copy(d[:], b)
+		digests = append(digests, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cdb.Get(digests)
+}
+
+// Close performs cleanup of the backend.
+func (cdb *CockroachDB) Close() {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	cdb.cron.Stop()
+	cdb.wallet.Close()
+	cdb.db.Close()
+}
+
+// dumpRecord and dumpAnchor are the on-disk representation Dump/Restore
+// use to move the contents of the records/anchors tables through a file.
+type dumpRecord struct {
+	Digest              string `json:"digest"`
+	AnchorMerkle        string `json:"anchor_merkle,omitempty"`
+	CollectionTimestamp string `json:"collection_timestamp"`
+}
+
+type dumpAnchor struct {
+	Merkle         string   `json:"merkle"`
+	Hashes         []string `json:"hashes"`
+	TxHash         string   `json:"tx_hash,omitempty"`
+	ChainTimestamp int64    `json:"chain_timestamp,omitempty"`
+	FlushTimestamp int64    `json:"flush_timestamp,omitempty"`
+}
+
+// Dump dumps database to the provided file descriptor. If the human flag
+// is set to true it pretty prints the database content, otherwise it
+// dumps a JSON stream.
+func (cdb *CockroachDB) Dump(f *os.File, human bool) error {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	anchors, err := cdb.dumpAnchors()
+	if err != nil {
+		return fmt.Errorf("dump anchors: %v", err)
+	}
+	records, err := cdb.dumpRecords()
+	if err != nil {
+		return fmt.Errorf("dump records: %v", err)
+	}
+
+	if human {
+		for _, a := range anchors {
+			fmt.Fprintf(f, "anchor %v tx=%v chain_timestamp=%v flush_timestamp=%v hashes=%v\n",
+				a.Merkle, a.TxHash, a.ChainTimestamp, a.FlushTimestamp, a.Hashes)
+		}
+		for _, r := range records {
+			fmt.Fprintf(f, "record %v anchor=%v collection_timestamp=%v\n",
+				r.Digest, r.AnchorMerkle, r.CollectionTimestamp)
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(f)
+	for _, a := range anchors {
+		if err := enc.Encode(struct {
+			Anchor dumpAnchor `json:"anchor"`
+		}{a}); err != nil {
+			return fmt.Errorf("encode anchor: %v", err)
+		}
+	}
+	for _, r := range records {
+		if err := enc.Encode(struct {
+			Record dumpRecord `json:"record"`
+		}{r}); err != nil {
+			return fmt.Errorf("encode record: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (cdb *CockroachDB) dumpAnchors() ([]dumpAnchor, error) {
+	rows, err := cdb.db.Query(`SELECT merkle, hashes, tx_hash, chain_timestamp,
+		flush_timestamp FROM ` + sqlbackend.TableAnchors)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var anchors []dumpAnchor
+	for rows.Next() {
+		var (
+			a       dumpAnchor
+			hashes  pq.StringArray
+			txHash  sql.NullString
+			chainTS sql.NullInt64
+			flushTS sql.NullInt64
+		)
+		if err := rows.Scan(&a.Merkle, &hashes, &txHash, &chainTS, &flushTS); err != nil {
+			return nil, err
+		}
+		a.Hashes = []string(hashes)
+		a.TxHash = txHash.String
+		a.ChainTimestamp = chainTS.Int64
+		a.FlushTimestamp = flushTS.Int64
+		anchors = append(anchors, a)
+	}
+	return anchors, rows.Err()
+}
+
+func (cdb *CockroachDB) dumpRecords() ([]dumpRecord, error) {
+	rows, err := cdb.db.Query(`SELECT digest, anchor_merkle, collection_timestamp
+		FROM ` + sqlbackend.TableRecords + ` ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []dumpRecord
+	for rows.Next() {
+		var (
+			r            dumpRecord
+			digest       []byte
+			anchorMerkle sql.NullString
+		)
+		if err := rows.Scan(&digest, &anchorMerkle, &r.CollectionTimestamp); err != nil {
+			return nil, err
+		}
+		r.Digest = hex.EncodeToString(digest)
+		r.AnchorMerkle = anchorMerkle.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Restore recreates the database from the provided file descriptor. The
+// verbose flag is set to true to indicate that this call may print to
+// stdout. The provided string describes the target location and is
+// implementation specific.
+func (cdb *CockroachDB) Restore(f *os.File, verbose bool, target string) error {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var envelope struct {
+			Anchor *dumpAnchor `json:"anchor"`
+			Record *dumpRecord `json:"record"`
+		}
+		if err := dec.Decode(&envelope); err != nil {
+			return fmt.Errorf("decode %v: %v", target, err)
+		}
+
+		switch {
+		case envelope.Anchor != nil:
+			a := envelope.Anchor
+			_, err := cdb.db.Exec(`INSERT INTO `+sqlbackend.TableAnchors+`
+				(merkle, hashes, tx_hash, chain_timestamp, flush_timestamp)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (merkle) DO NOTHING`,
+				a.Merkle, pq.StringArray(a.Hashes), nullIfEmpty(a.TxHash),
+				nullIfZero(a.ChainTimestamp), nullIfZero(a.FlushTimestamp))
+			if err != nil {
+				return fmt.Errorf("restore anchor %v: %v", a.Merkle, err)
+			}
+			if verbose {
+				log.Infof("Restored anchor %v", a.Merkle)
+			}
+		case envelope.Record != nil:
+			r := envelope.Record
+			digest, err := hex.DecodeString(r.Digest)
+			if err != nil {
+				return fmt.Errorf("restore record: decode digest %v: %v", r.Digest, err)
+			}
+			// records.key defaults to unique_rowid(), so unlike the
+			// postgres backend there is no serial sequence to reset
+			// after a restore.
+			_, err = cdb.db.Exec(`INSERT INTO `+sqlbackend.TableRecords+`
+				(digest, anchor_merkle, collection_timestamp)
+				VALUES ($1, $2, $3)`,
+				digest, nullIfEmpty(r.AnchorMerkle), r.CollectionTimestamp)
+			if err != nil {
+				return fmt.Errorf("restore record %v: %v", r.Digest, err)
+			}
+			if verbose {
+				log.Infof("Restored record %v", r.Digest)
+			}
+		}
+	}
+
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullIfZero(i int64) interface{} {
+	if i == 0 {
+		return nil
+	}
+	return i
+}
+
+// Fsck reports every record whose anchor_merkle references an anchor that
+// is missing from the anchors table. It does not check anchors against the
+// blockchain.
+func (cdb *CockroachDB) Fsck(*backend.FsckOptions) error {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	rows, err := cdb.db.Query(`SELECT r.digest, r.anchor_merkle FROM ` +
+		sqlbackend.TableRecords + ` r WHERE r.anchor_merkle IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM ` + sqlbackend.TableAnchors + ` a WHERE a.merkle = r.anchor_merkle)`)
+	if err != nil {
+		return fmt.Errorf("fsck query: %v", err)
+	}
+	defer rows.Close()
+
+	var broken []string
+	for rows.Next() {
+		var (
+			digest []byte
+			merkle string
+		)
+		if err := rows.Scan(&digest, &merkle); err != nil {
+			return fmt.Errorf("fsck scan: %v", err)
+		}
+		broken = append(broken, fmt.Sprintf("%x -> %v", digest, merkle))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(broken) != 0 {
+		return fmt.Errorf("fsck: %v record(s) reference a missing anchor: %v",
+			len(broken), broken)
+	}
+
+	return nil
+}
+
+// GetBalance retrieves balance information for the wallet backing this
+// instance.
+func (cdb *CockroachDB) GetBalance() (*backend.GetBalanceResult, error) {
+	return cdb.wallet.Balance()
+}
+
+// LastAnchor retrieves last successful anchor details.
+func (cdb *CockroachDB) LastAnchor() (*backend.LastAnchorResult, error) {
+	var (
+		merkleRoot string
+		flushTS    sql.NullInt64
+		chainTS    sql.NullInt64
+		txHash     sql.NullString
+	)
+
+	cdb.RLock()
+	row := cdb.db.QueryRow(cdb.queries.SelectLastAnchor)
+	err := row.Scan(&merkleRoot, &flushTS, &chainTS, &txHash)
+	cdb.RUnlock()
+	switch {
+	case err == sql.ErrNoRows:
+		return &backend.LastAnchorResult{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("last anchor: %v", err)
+	}
+
+	if txHash.Valid && txHash.String != "" && !chainTS.Valid {
+		confirmations, chainHeight, cerr := cdb.wallet.Confirmations(txHash.String)
+		if cerr != nil {
+			log.Errorf("LastAnchor: confirmations for %v: %v", txHash.String, cerr)
+		} else if confirmations > 0 {
+			chainTS.Int64 = chainHeight
+			chainTS.Valid = true
+			_, err = cdb.db.Exec(`UPDATE `+sqlbackend.TableAnchors+` SET chain_timestamp = $1
+				WHERE merkle = $2`, chainHeight, merkleRoot)
+			if err != nil {
+				log.Errorf("LastAnchor: record chain timestamp for %v: %v",
+					merkleRoot, err)
+			}
+		}
+	}
+
+	result := &backend.LastAnchorResult{
+		ChainTimestamp: chainTS.Int64,
+	}
+	if txHash.Valid && txHash.String != "" {
+		tx, err := chainhash.NewHashFromStr(txHash.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse tx hash %v: %v", txHash.String, err)
+		}
+		result.Tx = *tx
+	}
+
+	return result, nil
+}
+
+// doFlush mirrors postgres.Postgres.doFlush, but only runs the flush if it
+// can claim leadership of the cluster via the leader table, and wraps its
+// writes in the CRDB retry loop.
+func (cdb *CockroachDB) doFlush() (int, error) {
+	n, root, merkleRoot, err := cdb.flushLocked()
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	// Hand the root to the wallet for publication without holding
+	// cdb.Lock(): the Anchorer may talk to a wallet over RPC and must not block
+	// concurrent Put/Get calls for however long that RPC takes.
+	txHash, err := cdb.wallet.Publish(root)
+	if err != nil {
+		log.Errorf("doFlush: publish anchor %v: %v", merkleRoot, err)
+		return n, nil
+	}
+
+	_, err = cdb.db.Exec(cdb.queries.UpdateAnchorTxHash, txHash, merkleRoot)
+	if err != nil {
+		log.Errorf("doFlush: record tx hash for anchor %v: %v", merkleRoot, err)
+	}
+
+	return n, nil
+}
+
+// flushLocked selects every digest collected in the previous bucket that
+// has not yet been anchored, builds a Merkle tree of them and records the
+// resulting anchor, all under cdb.Lock(). It returns the flushed digest
+// count and the anchor's root so doFlush can hand the root off to the
+// wallet without holding the lock across that RPC call.
+func (cdb *CockroachDB) flushLocked() (int, [sha256.Size]byte, string, error) {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	var root [sha256.Size]byte
+
+	acquired, err := migrations.TryAcquireLeadership(cdb.db, cdb.owner, leaderTTL)
+	if err != nil {
+		return 0, root, "", fmt.Errorf("acquire leadership: %v", err)
+	}
+	if !acquired {
+		log.Infof("doFlush: another instance holds leadership, skipping")
+		return 0, root, "", nil
+	}
+
+	prevBucket := cdb.bucket(cdb.myNow().Add(-cdb.duration))
+
+	rows, err := cdb.db.Query(cdb.queries.SelectUnflushed, prevBucket)
+	if err != nil {
+		return 0, root, "", fmt.Errorf("select unflushed: %v", err)
+	}
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			rows.Close()
+			return 0, root, "", fmt.Errorf("scan unflushed: %v", err)
+		}
+		var d [sha256.Size]byte
+		copy(d[:], b)
+		digests = append(digests, d)
+	}
+	rows.Close()
+
+	if len(digests) == 0 {
+		return 0, root, "", nil
+	}
+
+	leaves := make([]*[sha256.Size]byte, len(digests))
+	for i := range digests {
+		leaves[i] = &digests[i]
+	}
+	root = *merkle.Root(leaves)
+	merkleRoot := fmt.Sprintf("%x", root)
+
+	hashes := make([]string, len(digests))
+	for i, d := range digests {
+		hashes[i] = fmt.Sprintf("%x", d)
+	}
+
+	flushTS := cdb.myNow().Unix()
+	err = sqlbackend.RunWithCRDBRetry(cdb.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(cdb.queries.InsertAnchor, merkleRoot, pq.StringArray(hashes), flushTS)
+		if err != nil {
+			return fmt.Errorf("insert anchor: %w", err)
+		}
+
+		_, err = tx.Exec(cdb.queries.UpdateRecordsAnchor, merkleRoot, prevBucket)
+		if err != nil {
+			return fmt.Errorf("update records: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, root, "", err
+	}
+
+	return len(digests), root, merkleRoot, nil
+}
+
+func buildQueryString(rootCert, cert, key string) string {
+	v := url.Values{}
+	v.Set("sslmode", "require")
+	v.Set("sslrootcert", filepath.Clean(rootCert))
+	v.Set("sslcert", filepath.Join(cert))
+	v.Set("sslkey", filepath.Join(key))
+	return v.Encode()
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	return pqErr.Code == "23505"
+}
+
+func internalNew(user, host, net, rootCert, cert, key string) (*CockroachDB, error) {
+	dbName := net + "_dcrtime"
+	h := "postgresql://" + user + "@" + host + "/" + dbName
+	u, err := url.Parse(h)
+	if err != nil {
+		return nil, fmt.Errorf("parse url '%v': %v", h, err)
+	}
+
+	qs := buildQueryString(rootCert, cert, key)
+	addr := u.String() + "?" + qs
+
+	db, err := sql.Open("postgres", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to database '%v': %v", addr, err)
+	}
+
+	err = migrations.Migrate(db, 0)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %v", err)
+	}
+
+	owner := fmt.Sprintf("%v-%v", host, os.Getpid())
+
+	cdb := &CockroachDB{
+		cron:     cron.New(),
+		db:       db,
+		duration: duration,
+		myNow:    time.Now,
+		queries:  sqlbackend.NewQueries(),
+		owner:    owner,
+	}
+
+	return cdb, nil
+}
+
+// New creates a new CockroachDB backend instance anchored to dcrwallet,
+// mirroring postgres.New. Deployments that want a different Anchorer
+// should use NewWithAnchorer instead. The caller should issue a Close
+// once the backend is no longer needed.
+func New(user, host, net, rootCert, cert, key, walletCert, walletHost, walletClientCert, walletClientKey string, enableCollections bool, walletPassphrase []byte) (*CockroachDB, error) {
+	dcrwalletanchor.UseLogger(log)
+	anchorer, err := dcrwalletanchor.New(walletCert, walletHost, walletClientCert, walletClientKey, walletPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	cdb, err := NewWithAnchorer(user, host, net, rootCert, cert, key, enableCollections, anchorer)
+	if err != nil {
+		anchorer.Close()
+		return nil, err
+	}
+	return cdb, nil
+}
+
+// NewWithAnchorer creates a new CockroachDB backend instance that
+// publishes flush roots via anchorer instead of assuming dcrwallet,
+// mirroring postgres.NewWithAnchorer.
+func NewWithAnchorer(user, host, net, rootCert, cert, key string, enableCollections bool, anchorer backend.Anchorer) (*CockroachDB, error) {
+	log.Tracef("New: %v %v %v %v %v %v", user, host, net, rootCert, cert, key)
+
+	cdb, err := internalNew(user, host, net, rootCert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	cdb.enableCollections = enableCollections
+	cdb.wallet = anchorer
+
+	start := time.Now()
+	flushed, err := cdb.doFlush()
+	end := time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if flushed != 0 {
+		log.Infof("Startup flusher: %v digests in %v", flushed, end)
+	}
+
+	err = cdb.cron.AddFunc(flushSchedule, func() {
+		flushed, err := cdb.doFlush()
+		if err != nil {
+			log.Errorf("doFlush: %v", err)
+			return
+		}
+		if flushed != 0 {
+			log.Infof("Flushed %v digests", flushed)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cdb.cron.Start()
+
+	return cdb, nil
+}
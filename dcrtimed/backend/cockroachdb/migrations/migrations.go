@@ -0,0 +1,248 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package migrations is the cockroachdb counterpart of
+// postgres/migrations: a numbered SQL migration runner tracked in a
+// schema_migrations table. CockroachDB has no advisory lock primitive, so
+// instead of pg_advisory_lock this runner serializes concurrent dcrtimed
+// instances by taking a row lock (SELECT ... FOR UPDATE) on a single row of
+// a dedicated `leader` table for the duration of the migration run.
+package migrations
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.up))
+	return fmt.Sprintf("%x", sum)
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(sqlFiles, "sql")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations dir: %v", err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed migration filename %q", name)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration version %q: %v", name, err)
+		}
+
+		contents, err := sqlFiles.ReadFile("sql/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("read migration %q: %v", name, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{
+				version: version,
+				name:    strings.TrimSuffix(strings.TrimSuffix(parts[1], ".down.sql"), ".up.sql"),
+			}
+			byVersion[version] = m
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			m.up = string(contents)
+		case strings.HasSuffix(name, ".down.sql"):
+			m.down = string(contents)
+		default:
+			return nil, fmt.Errorf("migration %q is neither .up.sql nor .down.sql", name)
+		}
+	}
+
+	migs := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migs = append(migs, *m)
+	}
+	sort.Slice(migs, func(i, j int) bool {
+		return migs[i].version < migs[j].version
+	})
+
+	return migs, nil
+}
+
+func ensureBookkeepingTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		checksum STRING NOT NULL
+	)`)
+	return err
+}
+
+func applied(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]string)
+	for rows.Next() {
+		var (
+			version  int
+			checksum string
+		)
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		out[version] = checksum
+	}
+	return out, rows.Err()
+}
+
+// withLeaderLock runs fn while holding a row lock on the single row of the
+// `leader` table, guaranteeing that only one dcrtimed instance applies
+// migrations at a time. The hourly flush cron contends for the same row
+// through TryAcquireLeadership instead.
+func withLeaderLock(db *sql.DB, fn func() error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin leader lock: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS leader (
+		id INT PRIMARY KEY,
+		owner STRING NOT NULL DEFAULT '',
+		acquired_at TIMESTAMPTZ
+	)`)
+	if err != nil {
+		return fmt.Errorf("ensure leader table: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO leader (id, acquired_at) VALUES (1, now())
+		ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("seed leader row: %v", err)
+	}
+
+	var id int
+	err = tx.QueryRow(`SELECT id FROM leader WHERE id = 1 FOR UPDATE`).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("lock leader row: %v", err)
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE leader SET acquired_at = now() WHERE id = 1`)
+	if err != nil {
+		return fmt.Errorf("update leader row: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// Migrate brings the schema up to target (or the latest known migration
+// when target is 0), serialized against other dcrtimed instances via the
+// leader table row lock.
+func Migrate(db *sql.DB, target int) error {
+	return withLeaderLock(db, func() error {
+		if err := ensureBookkeepingTable(db); err != nil {
+			return fmt.Errorf("ensure schema_migrations: %v", err)
+		}
+
+		migs, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+
+		have, err := applied(db)
+		if err != nil {
+			return fmt.Errorf("load applied migrations: %v", err)
+		}
+
+		for _, m := range migs {
+			if target != 0 && m.version > target {
+				break
+			}
+
+			checksum, ok := have[m.version]
+			if ok {
+				if checksum != m.checksum() {
+					return fmt.Errorf("migration %04d_%s: checksum drift, embedded "+
+						"migration no longer matches what was applied", m.version, m.name)
+				}
+				continue
+			}
+
+			if err := applyMigration(db, m); err != nil {
+				return fmt.Errorf("apply migration %04d_%s: %v", m.version, m.name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.up); err != nil {
+		return fmt.Errorf("run up script: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, checksum)
+		VALUES ($1, $2)`, m.version, m.checksum())
+	if err != nil {
+		return fmt.Errorf("record migration: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// TryAcquireLeadership reports whether the caller currently holds (or was
+// just granted) the leader row, without blocking. The hourly flush cron
+// uses this so that only one of several dcrtimed instances pointed at the
+// same cluster performs a given flush.
+func TryAcquireLeadership(db *sql.DB, owner string, ttl int64) (bool, error) {
+	res, err := db.Exec(`UPDATE leader SET owner = $1, acquired_at = now()
+		WHERE id = 1 AND (owner = '' OR owner = $1 OR
+			extract(epoch from now() - acquired_at) > $2)`, owner, ttl)
+	if err != nil {
+		return false, fmt.Errorf("acquire leadership: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
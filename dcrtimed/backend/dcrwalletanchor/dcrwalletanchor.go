@@ -0,0 +1,83 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package dcrwalletanchor adapts dcrtimewallet.DcrtimeWallet to the
+// backend.Anchorer interface. This is the anchorer every existing
+// dcrtimed deployment uses today; it is kept as a thin adapter so the
+// postgres and cockroachdb backends can be pointed at a different
+// Anchorer without depending on dcrwallet directly.
+package dcrwalletanchor
+
+import (
+	"fmt"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrtime/dcrtimed/backend"
+	"github.com/decred/dcrtime/dcrtimed/dcrtimewallet"
+	"github.com/decred/slog"
+)
+
+// DcrwalletAnchor implements backend.Anchorer on top of a dcrwallet RPC
+// connection.
+type DcrwalletAnchor struct {
+	wallet *dcrtimewallet.DcrtimeWallet
+}
+
+var _ backend.Anchorer = (*DcrwalletAnchor)(nil)
+
+// New dials the dcrwallet RPC described by cert/host, authenticating with
+// the client certificate pair at clientCert/clientKey, and returns an
+// Anchorer backed by it.
+func New(cert, host, clientCert, clientKey string, passphrase []byte) (*DcrwalletAnchor, error) {
+	wallet, err := dcrtimewallet.New(cert, host, clientCert, clientKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &DcrwalletAnchor{wallet: wallet}, nil
+}
+
+// UseLogger wires dcrtimewallet's logger to the caller's logger.
+func UseLogger(logger slog.Logger) {
+	dcrtimewallet.UseLogger(logger)
+}
+
+// Publish broadcasts a transaction committing to root via dcrwallet.
+func (d *DcrwalletAnchor) Publish(root [32]byte) (string, error) {
+	tx, err := d.wallet.Construct(root)
+	if err != nil {
+		return "", fmt.Errorf("construct: %v", err)
+	}
+	return tx.String(), nil
+}
+
+// Confirmations returns the confirmation count and mined height for
+// txHash.
+func (d *DcrwalletAnchor) Confirmations(txHash string) (uint32, int64, error) {
+	tx, err := chainhash.NewHashFromStr(txHash)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse tx hash %v: %v", txHash, err)
+	}
+
+	result, err := d.wallet.Lookup(*tx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("lookup: %v", err)
+	}
+	return result.Confirmations, result.BlockHeight, nil
+}
+
+// Balance returns the funding account's balance.
+func (d *DcrwalletAnchor) Balance() (*backend.GetBalanceResult, error) {
+	result, err := d.wallet.GetWalletBalance()
+	if err != nil {
+		return nil, fmt.Errorf("get wallet balance: %v", err)
+	}
+	return &backend.GetBalanceResult{
+		Total: result.Total,
+	}, nil
+}
+
+// Close releases the dcrwallet RPC connection.
+func (d *DcrwalletAnchor) Close() {
+	d.wallet.Close()
+}
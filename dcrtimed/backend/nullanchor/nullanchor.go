@@ -0,0 +1,41 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package nullanchor implements backend.Anchorer as a no-op, for
+// deployments that want to run dcrtimed in "collection only" mode: every
+// digest is still recorded and bucketed by the hourly flush, but the
+// Merkle root is never published anywhere on-chain.
+package nullanchor
+
+import "github.com/decred/dcrtime/dcrtimed/backend"
+
+// NullAnchor implements backend.Anchorer without talking to any wallet
+// or chain.
+type NullAnchor struct{}
+
+var _ backend.Anchorer = (*NullAnchor)(nil)
+
+// New returns a NullAnchor.
+func New() *NullAnchor {
+	return &NullAnchor{}
+}
+
+// Publish records nothing and returns an empty transaction hash.
+func (NullAnchor) Publish([32]byte) (string, error) {
+	return "", nil
+}
+
+// Confirmations always reports zero confirmations since nothing was ever
+// published.
+func (NullAnchor) Confirmations(string) (uint32, int64, error) {
+	return 0, 0, nil
+}
+
+// Balance returns a zero balance; there is no funding account.
+func (NullAnchor) Balance() (*backend.GetBalanceResult, error) {
+	return &backend.GetBalanceResult{}, nil
+}
+
+// Close is a no-op.
+func (NullAnchor) Close() {}
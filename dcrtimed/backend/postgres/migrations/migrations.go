@@ -0,0 +1,236 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package migrations implements a small, numbered schema migration runner
+// for the postgres backend, modeled on the approach taken by projects such
+// as Vikunja and Dex: migrations are plain SQL files embedded into the
+// binary, tracked in a schema_migrations bookkeeping table, and applied one
+// at a time inside their own transaction. A Postgres advisory lock is held
+// for the duration of Migrate so that multiple dcrtimed processes starting
+// concurrently do not race to apply the same migration twice.
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// advisoryLockID is an arbitrary, fixed key used for the Postgres advisory
+// lock that serializes migration runs across dcrtimed instances.
+const advisoryLockID = 0x64637274696d65 // The seven ASCII bytes of "dcrtime"
+
+// migration is a single numbered schema change, loaded from a pair of
+// up/down SQL files.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// checksum returns the hex-encoded sha256 of the up migration's contents.
+// It is recorded alongside the applied version so that drift between the
+// embedded migration and what was actually applied can be detected on the
+// next boot.
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.up))
+	return fmt.Sprintf("%x", sum)
+}
+
+// loadMigrations reads every embedded *.up.sql/*.down.sql pair and returns
+// them ordered by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(sqlFiles, "sql")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations dir: %v", err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed migration filename %q", name)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration version %q: %v", name, err)
+		}
+
+		contents, err := sqlFiles.ReadFile("sql/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("read migration %q: %v", name, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{
+				version: version,
+				name:    strings.TrimSuffix(strings.TrimSuffix(parts[1], ".down.sql"), ".up.sql"),
+			}
+			byVersion[version] = m
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			m.up = string(contents)
+		case strings.HasSuffix(name, ".down.sql"):
+			m.down = string(contents)
+		default:
+			return nil, fmt.Errorf("migration %q is neither .up.sql nor .down.sql", name)
+		}
+	}
+
+	migs := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migs = append(migs, *m)
+	}
+	sort.Slice(migs, func(i, j int) bool {
+		return migs[i].version < migs[j].version
+	})
+
+	return migs, nil
+}
+
+// ensureBookkeepingTable creates the schema_migrations table if it does not
+// already exist.
+func ensureBookkeepingTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		checksum TEXT NOT NULL
+	)`)
+	return err
+}
+
+// applied returns the versions already recorded in schema_migrations, along
+// with their recorded checksum.
+func applied(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[int]string)
+	for rows.Next() {
+		var (
+			version  int
+			checksum string
+		)
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		out[version] = checksum
+	}
+	return out, rows.Err()
+}
+
+// Migrate brings the schema up to target, or to the latest known migration
+// when target is 0. It is safe to call concurrently from multiple dcrtimed
+// processes; a Postgres advisory lock ensures only one of them performs the
+// upgrade while the others wait and then observe the schema already at the
+// desired version.
+//
+// The lock/unlock pair is session-scoped, so both calls are pinned to a
+// single *sql.Conn checked out of db's pool rather than issued through db
+// directly; db.Exec may hand the unlock to a different pooled connection
+// than the one that acquired the lock, leaving it held indefinitely.
+func Migrate(db *sql.DB, target int) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("checkout connection: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, advisoryLockID)
+	if err != nil {
+		return fmt.Errorf("acquire advisory lock: %v", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, advisoryLockID)
+
+	if err := ensureBookkeepingTable(ctx, conn); err != nil {
+		return fmt.Errorf("ensure schema_migrations: %v", err)
+	}
+
+	migs, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	have, err := applied(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("load applied migrations: %v", err)
+	}
+
+	for _, m := range migs {
+		if target != 0 && m.version > target {
+			break
+		}
+
+		checksum, ok := have[m.version]
+		if ok {
+			if checksum != m.checksum() {
+				return fmt.Errorf("migration %04d_%s: checksum drift, embedded "+
+					"migration no longer matches what was applied", m.version, m.name)
+			}
+			continue
+		}
+
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("apply migration %04d_%s: %v", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.up); err != nil {
+		return fmt.Errorf("run up script: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, checksum)
+		VALUES ($1, $2)`, m.version, m.checksum())
+	if err != nil {
+		return fmt.Errorf("record migration: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// ResetRecordsKeySequence resets the records.key serial sequence so that the
+// next key it hands out is one past the current maximum key. Restore calls
+// it once a restore completes so the sequence is never behind the keys
+// already in the table.
+func ResetRecordsKeySequence(db *sql.DB) error {
+	_, err := db.Exec(`SELECT setval(pg_get_serial_sequence('records', 'key'),
+		COALESCE((SELECT MAX(key) FROM records), 1))`)
+	if err != nil {
+		return fmt.Errorf("reset records.key sequence: %v", err)
+	}
+	return nil
+}
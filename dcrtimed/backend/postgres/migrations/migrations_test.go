@@ -0,0 +1,44 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import "testing"
+
+func TestLoadMigrationsOrderedAndPaired(t *testing.T) {
+	migs, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migs) == 0 {
+		t.Fatal("loadMigrations: expected at least one migration")
+	}
+
+	prev := -1
+	for _, m := range migs {
+		if m.version <= prev {
+			t.Fatalf("migrations out of order: %v after %v", m.version, prev)
+		}
+		prev = m.version
+
+		if m.up == "" {
+			t.Fatalf("migration %04d_%s: missing up script", m.version, m.name)
+		}
+		if m.down == "" {
+			t.Fatalf("migration %04d_%s: missing down script", m.version, m.name)
+		}
+	}
+}
+
+func TestChecksumIsDeterministic(t *testing.T) {
+	m := migration{version: 1, name: "init", up: "CREATE TABLE x (id INT);"}
+	if m.checksum() != m.checksum() {
+		t.Fatal("checksum is not deterministic")
+	}
+
+	other := migration{version: 1, name: "init", up: "CREATE TABLE y (id INT);"}
+	if m.checksum() == other.checksum() {
+		t.Fatal("checksum did not change with differing up script")
+	}
+}
@@ -7,22 +7,30 @@ package postgres
 import (
 	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/decred/dcrd/chaincfg/chainhash"
 	"github.com/decred/dcrtime/dcrtimed/backend"
-	"github.com/decred/dcrtime/dcrtimed/dcrtimewallet"
-	_ "github.com/lib/pq"
+	"github.com/decred/dcrtime/dcrtimed/backend/dcrwalletanchor"
+	"github.com/decred/dcrtime/dcrtimed/backend/nullanchor"
+	"github.com/decred/dcrtime/dcrtimed/backend/postgres/migrations"
+	"github.com/decred/dcrtime/dcrtimed/backend/sqlbackend"
+	"github.com/decred/dcrtime/merkle"
+	"github.com/lib/pq"
 	"github.com/robfig/cron"
 )
 
 const (
-	tableRecords = "records"
-	tableAnchors = "anchors"
+	tableRecords = sqlbackend.TableRecords
+	tableAnchors = sqlbackend.TableAnchors
 )
 
 var (
@@ -49,175 +57,681 @@ type Postgres struct {
 
 	enableCollections bool // Set to true to enable collection query
 
-	wallet *dcrtimewallet.DcrtimeWallet // Wallet context.
+	wallet  backend.Anchorer   // Publishes flush roots on-chain
+	queries sqlbackend.Queries // Shared SQL statements
+
+	// merklePaths caches the authentication path of every anchored digest
+	// Get has looked up so that Get does not have to recompute the tree
+	// for every lookup.
+	merklePaths map[string]*merkle.Branch // [merkle+digest]path
 
 	// testing only entries
 	myNow   func() time.Time // Override time.Now()
 	testing bool             // Enabled during test
 }
 
+// bucket returns the collection_timestamp bucket that t falls into. Digests
+// collected in the same bucket are flushed, and thus anchored, together.
+func (pg *Postgres) bucket(t time.Time) string {
+	return strconv.FormatInt(t.Truncate(pg.duration).Unix(), 10)
+}
+
+// Store hashes and return timestamp and associated errors.  Put is
+// allowed to return transient errors.
+func (pg *Postgres) Put(digests [][sha256.Size]byte) (int64, []backend.PutResult, error) {
+	pg.Lock()
+	defer pg.Unlock()
+
+	now := pg.myNow()
+	ts := now.Truncate(pg.duration).Unix()
+	bucket := pg.bucket(now)
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("begin put: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pg.queries.InsertRecord)
+	if err != nil {
+		return 0, nil, fmt.Errorf("prepare put: %v", err)
+	}
+	defer stmt.Close()
+
+	prs := make([]backend.PutResult, 0, len(digests))
+	for _, d := range digests {
+		// A failed insert aborts the whole transaction, so each insert
+		// runs behind a savepoint that a duplicate rolls back to.
+		if _, err = tx.Exec(`SAVEPOINT put_digest`); err != nil {
+			return 0, nil, fmt.Errorf("savepoint put: %v", err)
+		}
+		_, err = stmt.Exec(d[:], bucket)
+		switch {
+		case err == nil:
+			prs = append(prs, backend.PutResult{
+				Digest:    d,
+				ErrorCode: backend.ErrorOK,
+			})
+		case isUniqueViolation(err):
+			_, err = tx.Exec(`ROLLBACK TO SAVEPOINT put_digest`)
+			if err != nil {
+				return 0, nil, fmt.Errorf("rollback duplicate %x: %v", d, err)
+			}
+			prs = append(prs, backend.PutResult{
+				Digest:    d,
+				ErrorCode: backend.ErrorExists,
+			})
+		default:
+			return 0, nil, fmt.Errorf("insert digest %x: %v", d, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, fmt.Errorf("commit put: %v", err)
+	}
+
+	return ts, prs, nil
+}
+
 // Return timestamp information for given digests.
-func (pg *Postgres) Get([][sha256.Size]byte) ([]backend.GetResult, error) {
-	return nil, nil
+func (pg *Postgres) Get(digests [][sha256.Size]byte) ([]backend.GetResult, error) {
+	// get may populate pg.merklePaths, so this needs the exclusive lock
+	// rather than a read lock.
+	pg.Lock()
+	defer pg.Unlock()
+
+	grs := make([]backend.GetResult, 0, len(digests))
+	for _, d := range digests {
+		gr, err := pg.get(d)
+		if err != nil {
+			return nil, err
+		}
+		grs = append(grs, *gr)
+	}
+	return grs, nil
+}
+
+func (pg *Postgres) get(digest [sha256.Size]byte) (*backend.GetResult, error) {
+	var (
+		anchorMerkle sql.NullString
+		collectionTS string
+		flushTS      sql.NullInt64
+		chainTS      sql.NullInt64
+		txHash       sql.NullString
+	)
+	row := pg.db.QueryRow(pg.queries.SelectRecordGet, digest[:])
+	err := row.Scan(&anchorMerkle, &collectionTS, &flushTS, &chainTS, &txHash)
+	switch {
+	case err == sql.ErrNoRows:
+		return &backend.GetResult{
+			Digest:    digest,
+			ErrorCode: backend.ErrorNotFound,
+		}, nil
+	case err != nil:
+		return nil, fmt.Errorf("get digest %x: %v", digest, err)
+	}
+
+	gr := &backend.GetResult{
+		Digest:    digest,
+		ErrorCode: backend.ErrorOK,
+	}
+
+	if !anchorMerkle.Valid {
+		// Collected but not yet anchored.
+		return gr, nil
+	}
+
+	gr.AnchoredTimestamp = flushTS.Int64
+
+	if txHash.Valid && txHash.String != "" {
+		tx, err := chainhash.NewHashFromStr(txHash.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse tx hash %v: %v", txHash.String, err)
+		}
+		gr.Tx = *tx
+	}
+
+	root, branch, err := pg.merklePath(anchorMerkle.String, digest)
+	if err != nil {
+		return nil, err
+	}
+	gr.MerkleRoot = root
+	gr.MerklePath = *branch
+
+	return gr, nil
+}
+
+// merklePath returns the merkle root and authentication path for digest
+// within the anchor identified by merkleRoot (the anchors.merkle column,
+// hex encoded). Paths are cached in pg.merklePaths per anchor and digest,
+// since the set of digests behind an anchor does not change once flushed.
+// The caller must hold pg.Lock(), since this populates that map.
+func (pg *Postgres) merklePath(merkleRoot string, digest [sha256.Size]byte) ([sha256.Size]byte, *merkle.Branch, error) {
+	var root [sha256.Size]byte
+	rootBytes, err := hex.DecodeString(merkleRoot)
+	if err != nil {
+		return root, nil, fmt.Errorf("decode merkle root %q: %v", merkleRoot, err)
+	}
+	copy(root[:], rootBytes)
+
+	cacheKey := merkleRoot + hex.EncodeToString(digest[:])
+	if branch, ok := pg.merklePaths[cacheKey]; ok {
+		return root, branch, nil
+	}
+
+	rows, err := pg.db.Query(pg.queries.SelectAnchorDigests, merkleRoot)
+	if err != nil {
+		return root, nil, fmt.Errorf("select anchor digests: %v", err)
+	}
+	defer rows.Close()
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return root, nil, fmt.Errorf("scan anchor digest: %v", err)
+		}
+		var dd [sha256.Size]byte
+		copy(dd[:], b)
+		digests = append(digests, dd)
+	}
+
+	leaves := make([]*[sha256.Size]byte, len(digests))
+	for i := range digests {
+		leaves[i] = &digests[i]
+	}
+	branch := merkle.AuthPath(leaves, &digest)
+
+	if pg.merklePaths == nil {
+		pg.merklePaths = make(map[string]*merkle.Branch)
+	}
+	pg.merklePaths[cacheKey] = branch
+
+	return root, branch, nil
 }
 
 // Return all hashes for given timestamps.
-func (pg *Postgres) GetTimestamps([]int64) ([]backend.TimestampResult, error) {
-	return nil, nil
+func (pg *Postgres) GetTimestamps(timestamps []int64) ([]backend.TimestampResult, error) {
+	if !pg.enableCollections {
+		return nil, backend.ErrTryAgainLater
+	}
+
+	pg.RLock()
+	defer pg.RUnlock()
+
+	trs := make([]backend.TimestampResult, 0, len(timestamps))
+	for _, ts := range timestamps {
+		bucket := strconv.FormatInt(ts, 10)
+		rows, err := pg.db.Query(pg.queries.SelectTimestamp, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("select timestamp %v: %v", ts, err)
+		}
+
+		var digests [][sha256.Size]byte
+		for rows.Next() {
+			var b []byte
+			if err := rows.Scan(&b); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan timestamp digest: %v", err)
+			}
+			var d [sha256.Size]byte
+			copy(d[:], b)
+			digests = append(digests, d)
+		}
+		rows.Close()
+
+		trs = append(trs, backend.TimestampResult{
+			Timestamp: ts,
+			Digests:   digests,
+		})
+	}
+
+	return trs, nil
 }
 
-// Store hashes and return timestamp and associated errors.  Put is
-// allowed to return transient errors.
-func (pg *Postgres) Put([][sha256.Size]byte) (int64, []backend.PutResult, error) {
-	return 0, nil, nil
+// LastDigests returns timestamp information for the n most recently
+// collected digests.
+func (pg *Postgres) LastDigests(n int32) ([]backend.GetResult, error) {
+	rows, err := pg.db.Query(pg.queries.SelectLastDigests, n)
+	if err != nil {
+		return nil, fmt.Errorf("select last digests: %v", err)
+	}
+	defer rows.Close()
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, fmt.Errorf("scan last digest: %v", err)
+		}
+		var d [sha256.Size]byte
+		copy(d[:], b)
+		digests = append(digests, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return pg.Get(digests)
 }
 
 // Close performs cleanup of the backend.
 func (pg *Postgres) Close() {
+	pg.Lock()
+	defer pg.Unlock()
+
+	pg.cron.Stop()
+	pg.wallet.Close()
+	pg.db.Close()
+}
+
+// dumpRecord and dumpAnchor are the on-disk representation Dump/Restore
+// use to move the contents of the records/anchors tables through a file.
+//
+// Dump, Restore and Fsck below are real backend.Backend operations an
+// operator runs against a live deployment (backup, restore, integrity
+// check); they are not integration-test scaffolding.
+type dumpRecord struct {
+	Digest              string `json:"digest"`
+	AnchorMerkle        string `json:"anchor_merkle,omitempty"`
+	CollectionTimestamp string `json:"collection_timestamp"`
+}
+
+type dumpAnchor struct {
+	Merkle         string   `json:"merkle"`
+	Hashes         []string `json:"hashes"`
+	TxHash         string   `json:"tx_hash,omitempty"`
+	ChainTimestamp int64    `json:"chain_timestamp,omitempty"`
+	FlushTimestamp int64    `json:"flush_timestamp,omitempty"`
 }
 
 // Dump dumps database to the provided file descriptor. If the
 // human flag is set to true it pretty prints the database content
 // otherwise it dumps a JSON stream.
-func (pg *Postgres) Dump(*os.File, bool) error {
+func (pg *Postgres) Dump(f *os.File, human bool) error {
+	pg.RLock()
+	defer pg.RUnlock()
+
+	anchors, err := pg.dumpAnchors()
+	if err != nil {
+		return fmt.Errorf("dump anchors: %v", err)
+	}
+	records, err := pg.dumpRecords()
+	if err != nil {
+		return fmt.Errorf("dump records: %v", err)
+	}
+
+	if human {
+		for _, a := range anchors {
+			fmt.Fprintf(f, "anchor %v tx=%v chain_timestamp=%v flush_timestamp=%v hashes=%v\n",
+				a.Merkle, a.TxHash, a.ChainTimestamp, a.FlushTimestamp, a.Hashes)
+		}
+		for _, r := range records {
+			fmt.Fprintf(f, "record %v anchor=%v collection_timestamp=%v\n",
+				r.Digest, r.AnchorMerkle, r.CollectionTimestamp)
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(f)
+	for _, a := range anchors {
+		if err := enc.Encode(struct {
+			Anchor dumpAnchor `json:"anchor"`
+		}{a}); err != nil {
+			return fmt.Errorf("encode anchor: %v", err)
+		}
+	}
+	for _, r := range records {
+		if err := enc.Encode(struct {
+			Record dumpRecord `json:"record"`
+		}{r}); err != nil {
+			return fmt.Errorf("encode record: %v", err)
+		}
+	}
+
 	return nil
 }
 
+func (pg *Postgres) dumpAnchors() ([]dumpAnchor, error) {
+	rows, err := pg.db.Query(`SELECT merkle, hashes, tx_hash, chain_timestamp,
+		flush_timestamp FROM ` + tableAnchors)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var anchors []dumpAnchor
+	for rows.Next() {
+		var (
+			a       dumpAnchor
+			hashes  pq.StringArray
+			txHash  sql.NullString
+			chainTS sql.NullInt64
+			flushTS sql.NullInt64
+		)
+		if err := rows.Scan(&a.Merkle, &hashes, &txHash, &chainTS, &flushTS); err != nil {
+			return nil, err
+		}
+		a.Hashes = []string(hashes)
+		a.TxHash = txHash.String
+		a.ChainTimestamp = chainTS.Int64
+		a.FlushTimestamp = flushTS.Int64
+		anchors = append(anchors, a)
+	}
+	return anchors, rows.Err()
+}
+
+func (pg *Postgres) dumpRecords() ([]dumpRecord, error) {
+	rows, err := pg.db.Query(`SELECT digest, anchor_merkle, collection_timestamp
+		FROM ` + tableRecords + ` ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []dumpRecord
+	for rows.Next() {
+		var (
+			r            dumpRecord
+			digest       []byte
+			anchorMerkle sql.NullString
+		)
+		if err := rows.Scan(&digest, &anchorMerkle, &r.CollectionTimestamp); err != nil {
+			return nil, err
+		}
+		r.Digest = hex.EncodeToString(digest)
+		r.AnchorMerkle = anchorMerkle.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
 // Restore recreates the the database from the provided file
 // descriptor. The verbose flag is set to true to indicate that this
 // call may parint to stdout. The provided string describes the target
 // location and is implementation specific.
-func (pg *Postgres) Restore(*os.File, bool, string) error {
+func (pg *Postgres) Restore(f *os.File, verbose bool, target string) error {
+	pg.Lock()
+	defer pg.Unlock()
+
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var envelope struct {
+			Anchor *dumpAnchor `json:"anchor"`
+			Record *dumpRecord `json:"record"`
+		}
+		if err := dec.Decode(&envelope); err != nil {
+			return fmt.Errorf("decode %v: %v", target, err)
+		}
+
+		switch {
+		case envelope.Anchor != nil:
+			a := envelope.Anchor
+			_, err := pg.db.Exec(`INSERT INTO `+tableAnchors+`
+				(merkle, hashes, tx_hash, chain_timestamp, flush_timestamp)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (merkle) DO NOTHING`,
+				a.Merkle, pq.StringArray(a.Hashes), nullIfEmpty(a.TxHash),
+				nullIfZero(a.ChainTimestamp), nullIfZero(a.FlushTimestamp))
+			if err != nil {
+				return fmt.Errorf("restore anchor %v: %v", a.Merkle, err)
+			}
+			if verbose {
+				log.Infof("Restored anchor %v", a.Merkle)
+			}
+		case envelope.Record != nil:
+			r := envelope.Record
+			digest, err := hex.DecodeString(r.Digest)
+			if err != nil {
+				return fmt.Errorf("restore record: decode digest %v: %v", r.Digest, err)
+			}
+			_, err = pg.db.Exec(`INSERT INTO `+tableRecords+`
+				(digest, anchor_merkle, collection_timestamp)
+				VALUES ($1, $2, $3)`,
+				digest, nullIfEmpty(r.AnchorMerkle), r.CollectionTimestamp)
+			if err != nil {
+				return fmt.Errorf("restore record %v: %v", r.Digest, err)
+			}
+			if verbose {
+				log.Infof("Restored record %v", r.Digest)
+			}
+		}
+	}
+
+	if err := migrations.ResetRecordsKeySequence(pg.db); err != nil {
+		return fmt.Errorf("reset records.key sequence: %v", err)
+	}
+
 	return nil
 }
 
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullIfZero(i int64) interface{} {
+	if i == 0 {
+		return nil
+	}
+	return i
+}
+
 // Fsck walks all data and verifies its integrity. In addition it
 // verifies anchored timestamps' existence on the blockchain.
 func (pg *Postgres) Fsck(*backend.FsckOptions) error {
+	pg.RLock()
+	defer pg.RUnlock()
+
+	rows, err := pg.db.Query(`SELECT r.digest, r.anchor_merkle FROM ` +
+		tableRecords + ` r WHERE r.anchor_merkle IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM ` + tableAnchors + ` a WHERE a.merkle = r.anchor_merkle)`)
+	if err != nil {
+		return fmt.Errorf("fsck query: %v", err)
+	}
+	defer rows.Close()
+
+	var broken []string
+	for rows.Next() {
+		var (
+			digest []byte
+			merkle string
+		)
+		if err := rows.Scan(&digest, &merkle); err != nil {
+			return fmt.Errorf("fsck scan: %v", err)
+		}
+		broken = append(broken, fmt.Sprintf("%x -> %v", digest, merkle))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(broken) != 0 {
+		return fmt.Errorf("fsck: %v record(s) reference a missing anchor: %v",
+			len(broken), broken)
+	}
+
 	return nil
 }
 
 // GetBalance retrieves balance information for the wallet
 // backing this instance
 func (pg *Postgres) GetBalance() (*backend.GetBalanceResult, error) {
-	return nil, nil
+	return pg.wallet.Balance()
 }
 
 // LastAnchor retrieves last successful anchor details
 func (pg *Postgres) LastAnchor() (*backend.LastAnchorResult, error) {
-	return nil, nil
-}
+	var (
+		merkleRoot string
+		flushTS    sql.NullInt64
+		chainTS    sql.NullInt64
+		txHash     sql.NullString
+	)
+
+	pg.RLock()
+	row := pg.db.QueryRow(pg.queries.SelectLastAnchor)
+	err := row.Scan(&merkleRoot, &flushTS, &chainTS, &txHash)
+	pg.RUnlock()
+	switch {
+	case err == sql.ErrNoRows:
+		return &backend.LastAnchorResult{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("last anchor: %v", err)
+	}
 
-func buildQueryString(rootCert, cert, key string) string {
-	v := url.Values{}
-	v.Set("sslmode", "require")
-	v.Set("sslrootcert", filepath.Clean(rootCert))
-	v.Set("sslcert", filepath.Join(cert))
-	v.Set("sslkey", filepath.Join(key))
-	return v.Encode()
-}
+	// If the anchor has a transaction but hasn't been seen confirmed on
+	// chain yet, ask the anchorer whether that has changed since the
+	// last flush and persist the chain timestamp once it has.
+	if txHash.Valid && txHash.String != "" && !chainTS.Valid {
+		confirmations, chainHeight, cerr := pg.wallet.Confirmations(txHash.String)
+		if cerr != nil {
+			log.Errorf("LastAnchor: confirmations for %v: %v", txHash.String, cerr)
+		} else if confirmations > 0 {
+			chainTS.Int64 = chainHeight
+			chainTS.Valid = true
+			_, err = pg.db.Exec(`UPDATE `+tableAnchors+` SET chain_timestamp = $1
+				WHERE merkle = $2`, chainHeight, merkleRoot)
+			if err != nil {
+				log.Errorf("LastAnchor: record chain timestamp for %v: %v",
+					merkleRoot, err)
+			}
+		}
+	}
 
-func hasTable(db *sql.DB, name string) (bool, error) {
-	rows, err := db.Query(`SELECT EXISTS (SELECT FROM information_schema.tables 
-		WHERE table_schema = 'public' AND table_name  = $1)`, name)
-	if err != nil {
-		return false, err
+	result := &backend.LastAnchorResult{
+		ChainTimestamp: chainTS.Int64,
 	}
-	defer rows.Close()
-	var exists bool
-	for rows.Next() {
-		err = rows.Scan(&exists)
+	if txHash.Valid && txHash.String != "" {
+		tx, err := chainhash.NewHashFromStr(txHash.String)
 		if err != nil {
-			return false, err
+			return nil, fmt.Errorf("parse tx hash %v: %v", txHash.String, err)
 		}
+		result.Tx = *tx
 	}
-	return exists, nil
+
+	return result, nil
 }
 
-func createAnchorsTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE public.anchors
-(
-    merkle character varying(64) COLLATE pg_catalog."default" NOT NULL,
-    hashes text[] COLLATE pg_catalog."default" NOT NULL,
-    tx_hash text COLLATE pg_catalog."default",
-    chain_timestamp bigint,
-    flush_timestamp bigint,
-    CONSTRAINT anchors_pkey PRIMARY KEY (merkle)
-);
--- Index: idx_chain_timestamp
-CREATE INDEX idx_chain_timestamp
-    ON public.anchors USING btree
-    (chain_timestamp ASC NULLS LAST)
-    TABLESPACE pg_default;
--- Index: idx_flush_timestamp
-CREATE INDEX idx_flush_timestamp
-    ON public.anchors USING btree
-    (flush_timestamp ASC NULLS LAST)
-    TABLESPACE pg_default;
-`)
+// doFlush gathers every digest collected in the previous bucket that has not
+// yet been anchored, builds a Merkle tree of them, records the resulting
+// anchor and hands the root off to the wallet for on-chain publication. It
+// is invoked on the hourly cron as well as directly from tests.
+func (pg *Postgres) doFlush() (int, error) {
+	n, root, merkleRoot, err := pg.flushLocked()
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	// Hand the root to the wallet for publication without holding
+	// pg.Lock(): the Anchorer may talk to a wallet over RPC and must not block
+	// concurrent Put/Get calls for however long that RPC takes.
+	txHash, err := pg.wallet.Publish(root)
 	if err != nil {
-		return err
+		log.Errorf("doFlush: publish anchor %v: %v", merkleRoot, err)
+		return n, nil
 	}
-	log.Infof("Anchors table created")
-	return nil
-}
 
-func createRecordsTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE public.records
-(
-    digest bytea NOT NULL,
-    anchor_merkle character varying(64) COLLATE pg_catalog."default",
-    key serial NOT NULL,
-    collection_timestamp text COLLATE pg_catalog."default" NOT NULL,
-    CONSTRAINT records_pkey PRIMARY KEY (key),
-    CONSTRAINT records_anchors_fkey FOREIGN KEY (anchor_merkle)
-        REFERENCES public.anchors (merkle) MATCH SIMPLE
-        ON UPDATE NO ACTION
-        ON DELETE NO ACTION
-        NOT VALID
-);
-
--- Index: fki_records_anchors_fkey
-CREATE INDEX fki_records_anchors_fkey
-    ON public.records USING btree
-    (anchor_merkle COLLATE pg_catalog."default" ASC NULLS LAST)
-    TABLESPACE pg_default;
-
--- Index: idx_collection_timestamp
-CREATE INDEX idx_collection_timestamp
-    ON public.records USING btree
-    (collection_timestamp COLLATE pg_catalog."default" ASC NULLS LAST)
-    TABLESPACE pg_default;
-`)
+	_, err = pg.db.Exec(pg.queries.UpdateAnchorTxHash, txHash, merkleRoot)
 	if err != nil {
-		return err
+		log.Errorf("doFlush: record tx hash for anchor %v: %v", merkleRoot, err)
 	}
-	log.Infof("Records table created")
-	return nil
+
+	return n, nil
 }
 
-func createTables(db *sql.DB) error {
-	exists, err := hasTable(db, tableAnchors)
+// flushLocked selects every digest collected in the previous bucket that
+// has not yet been anchored, builds a Merkle tree of them and records the
+// resulting anchor, all under pg.Lock(). It returns the flushed digest
+// count and the anchor's root so doFlush can hand the root off to the
+// wallet without holding the lock across that RPC call.
+func (pg *Postgres) flushLocked() (int, [sha256.Size]byte, string, error) {
+	pg.Lock()
+	defer pg.Unlock()
+
+	var root [sha256.Size]byte
+
+	prevBucket := pg.bucket(pg.myNow().Add(-pg.duration))
+
+	rows, err := pg.db.Query(pg.queries.SelectUnflushed, prevBucket)
 	if err != nil {
-		return err
+		return 0, root, "", fmt.Errorf("select unflushed: %v", err)
 	}
-	if !exists {
-		err = createAnchorsTable(db)
-		if err != nil {
-			return err
+
+	var digests [][sha256.Size]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			rows.Close()
+			return 0, root, "", fmt.Errorf("scan unflushed: %v", err)
 		}
+		var d [sha256.Size]byte
+		copy(d[:], b)
+		digests = append(digests, d)
 	}
-	exists, err = hasTable(db, tableRecords)
+	rows.Close()
+
+	if len(digests) == 0 {
+		return 0, root, "", nil
+	}
+
+	leaves := make([]*[sha256.Size]byte, len(digests))
+	for i := range digests {
+		leaves[i] = &digests[i]
+	}
+	root = *merkle.Root(leaves)
+	merkleRoot := fmt.Sprintf("%x", root)
+
+	tx, err := pg.db.Begin()
 	if err != nil {
-		return err
+		return 0, root, "", fmt.Errorf("begin flush: %v", err)
 	}
-	if !exists {
-		err = createRecordsTable(db)
-		if err != nil {
-			return err
-		}
+	defer tx.Rollback()
+
+	hashes := make([]string, len(digests))
+	for i, d := range digests {
+		hashes[i] = fmt.Sprintf("%x", d)
 	}
-	return nil
+
+	_, err = tx.Exec(pg.queries.InsertAnchor,
+		merkleRoot, pq.StringArray(hashes), pg.myNow().Unix())
+	if err != nil {
+		return 0, root, "", fmt.Errorf("insert anchor: %v", err)
+	}
+
+	_, err = tx.Exec(pg.queries.UpdateRecordsAnchor, merkleRoot, prevBucket)
+	if err != nil {
+		return 0, root, "", fmt.Errorf("update records: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, root, "", fmt.Errorf("commit flush: %v", err)
+	}
+
+	return len(digests), root, merkleRoot, nil
+}
+
+func buildQueryString(rootCert, cert, key string) string {
+	v := url.Values{}
+	v.Set("sslmode", "require")
+	v.Set("sslrootcert", filepath.Clean(rootCert))
+	v.Set("sslcert", filepath.Join(cert))
+	v.Set("sslkey", filepath.Join(key))
+	return v.Encode()
+}
+
+// isUniqueViolation returns true when err is a Postgres unique_violation
+// (SQLSTATE 23505), which Put relies on to dedupe digests within a bucket.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	return pqErr.Code == "23505"
 }
 
 // internalNew creates the Pstgres context but does not launch background
@@ -239,10 +753,32 @@ func internalNew(user, host, net, rootCert, cert, key string) (*Postgres, error)
 		return nil, fmt.Errorf("connect to database '%v': %v", addr, err)
 	}
 
-	// Create tables
-	err = createTables(db)
+	// Bring the schema up to the latest known migration.
+	err = migrations.Migrate(db, 0)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("migrate: %v", err)
+	}
+
+	pg := &Postgres{
+		cron:     cron.New(),
+		db:       db,
+		duration: duration,
+		myNow:    time.Now,
+		queries:  sqlbackend.NewQueries(),
+	}
+
+	return pg, nil
+}
+
+// NewForIntegrationTest wraps an already-open, already-reachable database
+// connection (typically one handed out by the postgres/testdb harness) in
+// a *Postgres with its schema migrated and ready to exercise directly. It
+// anchors through nullanchor, so flushes need no wallet. It exists purely
+// for tests; production deployments always go through New.
+func NewForIntegrationTest(db *sql.DB) (*Postgres, error) {
+	err := migrations.Migrate(db, 0)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %v", err)
 	}
 
 	pg := &Postgres{
@@ -250,14 +786,56 @@ func internalNew(user, host, net, rootCert, cert, key string) (*Postgres, error)
 		db:       db,
 		duration: duration,
 		myNow:    time.Now,
+		wallet:   nullanchor.New(),
+		queries:  sqlbackend.NewQueries(),
+		testing:  true,
 	}
 
 	return pg, nil
 }
 
-// New creates a new backend instance.  The caller should issue a Close once
-// the Postgres backend is no longer needed.
-func New(user, host, net, rootCert, cert, key, walletCert, walletHost string, enableCollections bool, walletPassphrase []byte) (*Postgres, error) {
+// MigrateOnly connects to the database and brings the schema up to the
+// latest known migration without launching a full backend instance. This
+// backs the dcrtimed `--migrate-only` flag, which lets operators run
+// migrations out-of-band from a maintenance window before starting
+// dcrtimed proper.
+func MigrateOnly(user, host, net, rootCert, cert, key string) error {
+	pg, err := internalNew(user, host, net, rootCert, cert, key)
+	if err != nil {
+		return err
+	}
+	pg.db.Close()
+	return nil
+}
+
+// New creates a new backend instance anchored to dcrwallet, preserving the
+// historical signature every existing deployment configures. Deployments
+// that want a different Anchorer (a non-dcrwallet chain, or collection
+// only with no anchoring at all) should use NewWithAnchorer instead.
+// The caller should issue a Close once the Postgres backend is no longer
+// needed.
+func New(user, host, net, rootCert, cert, key, walletCert, walletHost, walletClientCert, walletClientKey string, enableCollections bool, walletPassphrase []byte) (*Postgres, error) {
+	dcrwalletanchor.UseLogger(log)
+	anchorer, err := dcrwalletanchor.New(walletCert, walletHost, walletClientCert, walletClientKey, walletPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	pg, err := NewWithAnchorer(user, host, net, rootCert, cert, key, enableCollections, anchorer)
+	if err != nil {
+		anchorer.Close()
+		return nil, err
+	}
+	return pg, nil
+}
+
+// NewWithAnchorer creates a new backend instance that publishes flush
+// roots via anchorer instead of assuming dcrwallet. This is what lets the
+// postgres backend run against any Anchorer implementation (a
+// wire-compatible chain over RPC, or nullanchor for collection-only
+// deployments where dcrwallet isn't available at all). The caller should
+// issue a Close once the Postgres backend is no longer needed.
+func NewWithAnchorer(user, host, net, rootCert, cert, key string, enableCollections bool, anchorer backend.Anchorer) (*Postgres, error) {
 	// XXX log more stuff
 	log.Tracef("New: %v %v %v %v %v %v", user, host, net, rootCert, cert, key)
 
@@ -266,28 +844,30 @@ func New(user, host, net, rootCert, cert, key, walletCert, walletHost string, en
 		return nil, err
 	}
 	pg.enableCollections = enableCollections
+	pg.wallet = anchorer
 
-	// Runtime bits
-	dcrtimewallet.UseLogger(log)
-	pg.wallet, err = dcrtimewallet.New(walletCert, walletHost, walletPassphrase)
+	// Flushing backend reconciles uncommitted work to the global database.
+	start := time.Now()
+	flushed, err := pg.doFlush()
+	end := time.Since(start)
 	if err != nil {
 		return nil, err
 	}
 
-	// Flushing backend reconciles uncommitted work to the global database.
-	//start := time.Now()
-	//flushed, err := pg.doFlush()
-	//end := time.Since(start)
-	//if err != nil {
-	//return nil, err
-	//}
-
-	//if flushed != 0 {
-	//log.Infof("Startup flusher: directories %v in %v", flushed, end)
-	//}
+	if flushed != 0 {
+		log.Infof("Startup flusher: %v digests in %v", flushed, end)
+	}
 
 	// Launch cron.
 	err = pg.cron.AddFunc(flushSchedule, func() {
+		flushed, err := pg.doFlush()
+		if err != nil {
+			log.Errorf("doFlush: %v", err)
+			return
+		}
+		if flushed != 0 {
+			log.Infof("Flushed %v digests", flushed)
+		}
 	})
 	if err != nil {
 		return nil, err
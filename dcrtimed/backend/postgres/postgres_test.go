@@ -0,0 +1,181 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// +build integration
+
+package postgres
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrtime/dcrtimed/backend"
+	"github.com/decred/dcrtime/dcrtimed/backend/postgres/testdb"
+)
+
+// newTestPostgres stands up a disposable database via the testdb harness
+// and wraps it in a *Postgres, registering a cleanup that tears the
+// database down when the test completes.
+func newTestPostgres(t *testing.T) *Postgres {
+	t.Helper()
+
+	db, err := testdb.New()
+	if err != nil {
+		t.Fatalf("testdb.New: %v", err)
+	}
+	t.Cleanup(db.Teardown)
+
+	pg, err := NewForIntegrationTest(db.DB)
+	if err != nil {
+		t.Fatalf("NewForIntegrationTest: %v", err)
+	}
+
+	return pg
+}
+
+func digestOf(b byte) [sha256.Size]byte {
+	return sha256.Sum256([]byte{b})
+}
+
+// advanceOneBucket rolls pg's clock forward by one full duration, so that
+// the bucket digests were just Put into becomes the "previous" bucket
+// doFlush acts on.
+func advanceOneBucket(pg *Postgres) {
+	pg.myNow = func() time.Time {
+		return time.Now().Add(pg.duration)
+	}
+}
+
+func TestPutFlushGet(t *testing.T) {
+	pg := newTestPostgres(t)
+
+	d := digestOf(1)
+	_, prs, err := pg.Put([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if prs[0].ErrorCode != backend.ErrorOK {
+		t.Fatalf("Put: unexpected error code %v", prs[0].ErrorCode)
+	}
+
+	advanceOneBucket(pg)
+
+	n, err := pg.doFlush()
+	if err != nil {
+		t.Fatalf("doFlush: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("doFlush: got %v flushed, want 1", n)
+	}
+
+	grs, err := pg.Get([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if grs[0].ErrorCode != backend.ErrorOK {
+		t.Fatalf("Get: unexpected error code %v", grs[0].ErrorCode)
+	}
+	if grs[0].AnchoredTimestamp == 0 {
+		t.Fatalf("Get: expected a non-zero anchored timestamp")
+	}
+}
+
+func TestPutDedupeWithinBucket(t *testing.T) {
+	pg := newTestPostgres(t)
+
+	d := digestOf(2)
+	_, _, err := pg.Put([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, prs, err := pg.Put([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Put (dup): %v", err)
+	}
+	if prs[0].ErrorCode != backend.ErrorExists {
+		t.Fatalf("Put (dup): got %v, want ErrorExists", prs[0].ErrorCode)
+	}
+}
+
+// TestFsckDetectsMissingAnchor verifies that Fsck flags a record whose
+// anchor_merkle points at a row that no longer exists in the anchors
+// table, simulating a partially-applied manual repair.
+func TestFsckDetectsMissingAnchor(t *testing.T) {
+	pg := newTestPostgres(t)
+
+	d := digestOf(3)
+	_, _, err := pg.Put([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	advanceOneBucket(pg)
+	if _, err := pg.doFlush(); err != nil {
+		t.Fatalf("doFlush: %v", err)
+	}
+
+	// Corrupt the anchor out from under the record.
+	_, err = pg.db.Exec(`DELETE FROM anchors`)
+	if err != nil {
+		t.Fatalf("corrupt anchors: %v", err)
+	}
+
+	err = pg.Fsck(&backend.FsckOptions{})
+	if err == nil {
+		t.Fatal("Fsck: expected an error for a record with a dangling anchor_merkle")
+	}
+}
+
+// TestRestoreRoundTrip dumps the database, wipes it, restores from the
+// dump, and verifies the original digest is reachable again.
+func TestRestoreRoundTrip(t *testing.T) {
+	pg := newTestPostgres(t)
+
+	d := digestOf(4)
+	_, _, err := pg.Put([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	advanceOneBucket(pg)
+	if _, err := pg.doFlush(); err != nil {
+		t.Fatalf("doFlush: %v", err)
+	}
+
+	f, err := os.CreateTemp("", "dcrtime-dump-*.json")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := pg.Dump(f, false); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	f.Close()
+
+	if _, err := pg.db.Exec(`DELETE FROM records; DELETE FROM anchors`); err != nil {
+		t.Fatalf("wipe before restore: %v", err)
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("Open dump: %v", err)
+	}
+	defer r.Close()
+
+	if err := pg.Restore(r, false, "restore-test"); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	grs, err := pg.Get([][sha256.Size]byte{d})
+	if err != nil {
+		t.Fatalf("Get after restore: %v", err)
+	}
+	if grs[0].ErrorCode != backend.ErrorOK {
+		t.Fatalf("Get after restore: got %v, want ErrorOK", grs[0].ErrorCode)
+	}
+}
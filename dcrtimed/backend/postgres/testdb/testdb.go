@@ -0,0 +1,161 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// +build integration
+
+// Package testdb stands up a disposable Postgres instance for the
+// postgres backend's integration tests, modeled on the docker-based
+// standup helpers used by dex. When PG_HOST (and optionally PG_USER,
+// PG_PASSWORD) are set in the environment, as they are in the
+// postgres-integration CI job, it connects to that instance directly.
+// Otherwise it shells out to `docker run` to launch a throwaway
+// postgres:13 container on the local machine, which is the common case
+// for a contributor iterating locally with Docker installed.
+//
+// This package, and everything that imports it, is gated behind the
+// `integration` build tag so `go test ./...` stays green for
+// contributors without Docker or a reachable Postgres.
+package testdb
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// DB is a connection to a disposable test database, along with the
+// Teardown func that releases it.
+type DB struct {
+	*sql.DB
+	Teardown func()
+}
+
+// New returns a connection to a ready-to-use Postgres database, along with
+// a teardown func the caller must invoke (typically via defer) once the
+// test is done with it. A docker-launched database starts empty; with
+// PG_HOST set, the dcrtime_test database is used as is and is not cleared
+// between calls.
+func New() (*DB, error) {
+	if host := os.Getenv("PG_HOST"); host != "" {
+		return connect(host, envOr("PG_USER", "postgres"), envOr("PG_PASSWORD", ""))
+	}
+	return newDockerPostgres()
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func connect(host, user, password string) (*DB, error) {
+	dsn := fmt.Sprintf("postgresql://%v@%v/dcrtime_test?sslmode=disable", user, host)
+	if password != "" {
+		dsn = fmt.Sprintf("postgresql://%v:%v@%v/dcrtime_test?sslmode=disable",
+			user, password, host)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", dsn, err)
+	}
+
+	if err := waitForReady(db, 30*time.Second); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE DATABASE dcrtime_test`); err != nil &&
+		!strings.Contains(err.Error(), "already exists") {
+		// Ignore failures to create the throwaway database; most
+		// hosted Postgres instances in CI already provision it.
+	}
+
+	return &DB{
+		DB:       db,
+		Teardown: func() { db.Close() },
+	}, nil
+}
+
+// newDockerPostgres launches a throwaway postgres:13 container, waits for
+// it to accept connections, and returns a DB whose Teardown stops and
+// removes the container.
+func newDockerPostgres() (*DB, error) {
+	const (
+		user     = "postgres"
+		password = "dcrtime"
+	)
+
+	out, err := exec.Command("docker", "run", "-d", "-P",
+		"-e", "POSTGRES_USER="+user,
+		"-e", "POSTGRES_PASSWORD="+password,
+		"-e", "POSTGRES_DB=dcrtime_test",
+		"postgres:13").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker run postgres:13: %v: %s", err, out)
+	}
+	containerID := strings.TrimSpace(string(out))
+
+	teardown := func() {
+		exec.Command("docker", "rm", "-f", containerID).Run()
+	}
+
+	port, err := mappedPort(containerID)
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+
+	dsn := fmt.Sprintf("postgresql://%v:%v@127.0.0.1:%v/dcrtime_test?sslmode=disable",
+		user, password, port)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		teardown()
+		return nil, fmt.Errorf("open %v: %v", dsn, err)
+	}
+
+	if err := waitForReady(db, 60*time.Second); err != nil {
+		teardown()
+		return nil, err
+	}
+
+	return &DB{
+		DB: db,
+		Teardown: func() {
+			db.Close()
+			teardown()
+		},
+	}, nil
+}
+
+func mappedPort(containerID string) (string, error) {
+	out, err := exec.Command("docker", "port", containerID, "5432/tcp").Output()
+	if err != nil {
+		return "", fmt.Errorf("docker port %v: %v", containerID, err)
+	}
+	// Output looks like "0.0.0.0:32768"; grab everything after the colon.
+	fields := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected docker port output %q", out)
+	}
+	return fields[1], nil
+}
+
+func waitForReady(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if lastErr = db.Ping(); lastErr == nil {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("database did not become ready: %v", lastErr)
+}
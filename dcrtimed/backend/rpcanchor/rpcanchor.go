@@ -0,0 +1,175 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package rpcanchor implements backend.Anchorer over a generic JSON-RPC
+// URL, for anchoring to any wire-compatible chain that exposes an
+// OP_RETURN-capable wallet RPC (createrawtransaction / fundrawtransaction
+// / signrawtransaction / sendrawtransaction / gettransaction / getbalance)
+// rather than requiring dcrwallet specifically. This is
+// useful for testnets, and for operators who want to anchor to a cheaper
+// chain than the one dcrwallet is configured for.
+package rpcanchor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/decred/dcrtime/dcrtimed/backend"
+)
+
+// RPCAnchor implements backend.Anchorer by issuing OP_RETURN transactions
+// over a JSON-RPC URL.
+type RPCAnchor struct {
+	url    string
+	user   string
+	pass   string
+	client *http.Client
+}
+
+var _ backend.Anchorer = (*RPCAnchor)(nil)
+
+// New returns an Anchorer that publishes to the wallet RPC listening at
+// url, authenticating with user/pass.
+func New(url, user, pass string) *RPCAnchor {
+	return &RPCAnchor{
+		url:    url,
+		user:   user,
+		pass:   pass,
+		client: &http.Client{},
+	}
+}
+
+type rpcRequest struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (a *RPCAnchor) call(method string, params []interface{}, out interface{}) error {
+	reqBody, err := json.Marshal(rpcRequest{
+		Jsonrpc: "1.0",
+		ID:      1,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(a.user, a.pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("rpc %v: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var rr rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return fmt.Errorf("rpc %v: decode response: %v", method, err)
+	}
+	if rr.Error != nil {
+		return fmt.Errorf("rpc %v: %v", method, rr.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(rr.Result, out)
+}
+
+// Publish creates, funds, signs and broadcasts an OP_RETURN transaction
+// committing to root, returning the resulting transaction hash.
+func (a *RPCAnchor) Publish(root [32]byte) (string, error) {
+	opReturn := fmt.Sprintf("%x", root)
+
+	var rawTx string
+	err := a.call("createrawtransaction", []interface{}{
+		[]interface{}{}, map[string]string{"data": opReturn},
+	}, &rawTx)
+	if err != nil {
+		return "", fmt.Errorf("createrawtransaction: %v", err)
+	}
+
+	// The raw transaction above has no inputs and is unsigned; the wallet
+	// needs to select UTXOs to cover the fee and sign the result before
+	// it can be broadcast.
+	var funded struct {
+		Hex string `json:"hex"`
+	}
+	err = a.call("fundrawtransaction", []interface{}{rawTx}, &funded)
+	if err != nil {
+		return "", fmt.Errorf("fundrawtransaction: %v", err)
+	}
+
+	var signed struct {
+		Hex      string `json:"hex"`
+		Complete bool   `json:"complete"`
+	}
+	err = a.call("signrawtransaction", []interface{}{funded.Hex}, &signed)
+	if err != nil {
+		return "", fmt.Errorf("signrawtransaction: %v", err)
+	}
+	if !signed.Complete {
+		return "", fmt.Errorf("signrawtransaction: incomplete signature")
+	}
+
+	var txHash string
+	err = a.call("sendrawtransaction", []interface{}{signed.Hex}, &txHash)
+	if err != nil {
+		return "", fmt.Errorf("sendrawtransaction: %v", err)
+	}
+
+	return txHash, nil
+}
+
+// Confirmations returns the confirmation count and block height for
+// txHash, via the RPC's gettransaction call.
+func (a *RPCAnchor) Confirmations(txHash string) (uint32, int64, error) {
+	var result struct {
+		Confirmations uint32 `json:"confirmations"`
+		BlockHeight   int64  `json:"blockheight"`
+	}
+	err := a.call("gettransaction", []interface{}{txHash}, &result)
+	if err != nil {
+		return 0, 0, fmt.Errorf("gettransaction: %v", err)
+	}
+	return result.Confirmations, result.BlockHeight, nil
+}
+
+// coinToAtoms is the conversion factor between the wallet RPC's
+// getbalance, which reports whole coins as a float64, and
+// backend.GetBalanceResult.Total, which (like the rest of this codebase)
+// counts atoms.
+const coinToAtoms = 1e8
+
+// Balance returns the funding account's balance via the RPC's
+// getbalance call.
+func (a *RPCAnchor) Balance() (*backend.GetBalanceResult, error) {
+	var total float64
+	err := a.call("getbalance", nil, &total)
+	if err != nil {
+		return nil, fmt.Errorf("getbalance: %v", err)
+	}
+	return &backend.GetBalanceResult{
+		Total: int64(total * coinToAtoms),
+	}, nil
+}
+
+// Close is a no-op; RPCAnchor does not hold a persistent connection.
+func (a *RPCAnchor) Close() {}
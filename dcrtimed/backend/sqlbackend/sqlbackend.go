@@ -0,0 +1,142 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package sqlbackend holds the SQL statements shared by every backend that
+// speaks the Postgres wire protocol against the records/anchors schema
+// (currently postgres and cockroachdb). The statements themselves do not
+// vary between dialects; what varies is how each backend generates primary
+// keys, retries transactions, and elects a single instance to run the
+// hourly flush cron, all of which remain the concern of the individual
+// backend packages.
+package sqlbackend
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Table names shared by every SQL-wire-protocol backend.
+const (
+	TableRecords = "records"
+	TableAnchors = "anchors"
+)
+
+// Queries is the set of parametrized SQL statements that drive the
+// timestamping pipeline. Both postgres and cockroachdb build one of these
+// and use it verbatim; only the DDL that creates the schema, and the
+// transaction retry/locking strategy around these statements, differs
+// between them.
+type Queries struct {
+	InsertRecord        string
+	SelectRecordGet     string
+	SelectAnchorDigests string
+	SelectTimestamp     string
+	InsertAnchor        string
+	UpdateRecordsAnchor string
+	UpdateAnchorTxHash  string
+	SelectUnflushed     string
+	SelectLastAnchor    string
+	SelectLastDigests   string
+}
+
+// NewQueries returns the shared query set. It takes no dialect argument
+// because every statement here is plain, portable SQL; callers needing
+// dialect-specific DDL or locking build that separately.
+func NewQueries() Queries {
+	return Queries{
+		InsertRecord: `INSERT INTO ` + TableRecords + `
+			(digest, collection_timestamp) VALUES ($1, $2)`,
+
+		SelectRecordGet: `SELECT r.anchor_merkle, r.collection_timestamp,
+				a.flush_timestamp, a.chain_timestamp, a.tx_hash
+			FROM ` + TableRecords + ` r
+			LEFT JOIN ` + TableAnchors + ` a ON r.anchor_merkle = a.merkle
+			WHERE r.digest = $1`,
+
+		SelectAnchorDigests: `SELECT digest FROM ` + TableRecords + `
+			WHERE anchor_merkle = $1 ORDER BY key`,
+
+		SelectTimestamp: `SELECT digest FROM ` + TableRecords + `
+			WHERE collection_timestamp = $1`,
+
+		InsertAnchor: `INSERT INTO ` + TableAnchors + `
+			(merkle, hashes, flush_timestamp) VALUES ($1, $2, $3)`,
+
+		UpdateRecordsAnchor: `UPDATE ` + TableRecords + ` SET anchor_merkle = $1
+			WHERE collection_timestamp = $2 AND anchor_merkle IS NULL`,
+
+		UpdateAnchorTxHash: `UPDATE ` + TableAnchors + ` SET tx_hash = $1
+			WHERE merkle = $2`,
+
+		SelectUnflushed: `SELECT digest FROM ` + TableRecords + `
+			WHERE collection_timestamp = $1 AND anchor_merkle IS NULL
+			ORDER BY key`,
+
+		SelectLastAnchor: `SELECT merkle, flush_timestamp, chain_timestamp, tx_hash
+			FROM ` + TableAnchors + `
+			ORDER BY flush_timestamp DESC NULLS LAST LIMIT 1`,
+
+		SelectLastDigests: `SELECT digest FROM ` + TableRecords + `
+			ORDER BY key DESC LIMIT $1`,
+	}
+}
+
+// crdbRetryableSQLState is the SQLSTATE CockroachDB returns when a
+// transaction must be retried due to a serialization conflict.
+const crdbRetryableSQLState = "40001"
+
+// RunWithCRDBRetry runs fn inside a transaction, retrying with exponential
+// backoff when CockroachDB reports a serialization conflict (SQLSTATE
+// 40001). Postgres does not use this helper: its default isolation level
+// does not produce this class of error for the access patterns used here.
+func RunWithCRDBRetry(db *sql.DB, fn func(*sql.Tx) error) error {
+	backoff := 5 * time.Millisecond
+	const maxAttempts = 10
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = fn(tx)
+		if err != nil {
+			tx.Rollback()
+			if isRetryable(err) {
+				lastErr = err
+				time.Sleep(backoff)
+				backoff *= 2
+				continue
+			}
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			if isRetryable(err) {
+				lastErr = err
+				time.Sleep(backoff)
+				backoff *= 2
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+
+	return lastErr
+}
+
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return string(pqErr.Code) == crdbRetryableSQLState
+}